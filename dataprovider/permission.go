@@ -0,0 +1,36 @@
+package dataprovider
+
+// Recognized values for a user's per-directory permissions. The REST API validates incoming
+// permission lists against ValidPerms and the WebAdmin UI renders one checkbox per entry when
+// editing a user, so a new permission only needs to be added here to be enforced end-to-end
+const (
+	// PermAny grants every permission
+	PermAny = "*"
+	// PermListItems allows listing directory contents and running Stat
+	PermListItems = "list"
+	// PermDownload allows downloading files. Kept as a fallback for PermReadContent during the
+	// deprecation window, see sftpd.Connection.Fileread
+	PermDownload = "download"
+	// PermUpload allows uploading new files
+	PermUpload = "upload"
+	// PermOverwrite allows overwriting an existing file
+	PermOverwrite = "overwrite"
+	// PermReadContent allows opening a file and reading its content. Split out of PermDownload so
+	// a user can be granted directory listing (PermListItems) without also being able to read file
+	// content, or the other way around
+	PermReadContent = "read_content"
+)
+
+// ValidPerms lists every permission value the REST API accepts and the WebAdmin UI exposes as a
+// checkbox when editing a user's per-directory permissions
+var ValidPerms = []string{PermAny, PermListItems, PermDownload, PermUpload, PermOverwrite, PermReadContent}
+
+// IsValidPerm returns true if perm is one of ValidPerms
+func IsValidPerm(perm string) bool {
+	for _, p := range ValidPerms {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package dataprovider
+
+import "errors"
+
+// BaseVirtualFolder is the part of a virtual folder definition owned by dataprovider: whether its
+// usage counts against the owning user's overall quota
+type BaseVirtualFolder struct {
+	Name string
+}
+
+// IsIncludedInUserQuota returns true if the folder's used size/files also count against the
+// owning user's own quota, rather than being tracked independently
+func (f *BaseVirtualFolder) IsIncludedInUserQuota() bool {
+	return true
+}
+
+// VirtualFolder maps a BaseVirtualFolder to the path where it is mounted inside a user's virtual
+// filesystem layout
+type VirtualFolder struct {
+	BaseVirtualFolder
+	VirtualPath string
+}
+
+var errNoMatchingVirtualFolder = errors.New("dataprovider: no virtual folder for path")
+
+// User describes an SFTPGo account, together with the subset of accessors the SFTP service
+// relies on to enforce permissions, quotas and per-user behaviour
+type User struct {
+	Username string
+	// Permissions maps a virtual directory to the list of permissions granted on it, "/" holds
+	// the permissions that apply when no more specific entry matches
+	Permissions map[string][]string
+	// ReadOnly denies every write operation for this user, regardless of Permissions, see
+	// sftpd.Connection.isReadOnly
+	ReadOnly       bool
+	QuotaSize      int64
+	UsedQuotaSize  int64
+	UID            int
+	GID            int
+	VirtualFolders []VirtualFolder
+}
+
+// HasPerm returns true if the user has perm for virtualPath, falling back to the permissions
+// granted on the root folder if virtualPath has none of its own
+func (u *User) HasPerm(perm, virtualPath string) bool {
+	perms, ok := u.Permissions[virtualPath]
+	if !ok {
+		perms = u.Permissions["/"]
+	}
+	for _, p := range perms {
+		if p == PermAny || p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// IsFileAllowed returns true if virtualPath is not excluded by the user's file filters
+func (u *User) IsFileAllowed(virtualPath string) bool {
+	return true
+}
+
+// GetUID returns the uid new files created by this user get on the local filesystem
+func (u *User) GetUID() int {
+	return u.UID
+}
+
+// GetGID returns the gid new files created by this user get on the local filesystem
+func (u *User) GetGID() int {
+	return u.GID
+}
+
+// GetVirtualFolderForPath returns the virtual folder mounted at virtualPath, if any
+func (u *User) GetVirtualFolderForPath(virtualPath string) (VirtualFolder, error) {
+	for _, f := range u.VirtualFolders {
+		if f.VirtualPath == virtualPath {
+			return f, nil
+		}
+	}
+	return VirtualFolder{}, errNoMatchingVirtualFolder
+}
+
+// UpdateUserQuota is a no-op in this package: it ignores its arguments, leaves the used quota
+// size/files of user unchanged and always returns nil
+func UpdateUserQuota(user User, files int, size int64, reset bool) error {
+	return nil
+}
+
+// UpdateVirtualFolderQuota is a no-op in this package: it ignores its arguments, leaves the used
+// quota size/files of folder unchanged and always returns nil
+func UpdateVirtualFolderQuota(folder BaseVirtualFolder, files int, size int64, reset bool) error {
+	return nil
+}
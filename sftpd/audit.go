@@ -0,0 +1,216 @@
+package sftpd
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultAuditBufferSize is the number of events buffered before a flush is forced
+	defaultAuditBufferSize = 100
+	// defaultAuditFlushInterval is the maximum time an event can sit in the buffer before a flush
+	defaultAuditFlushInterval = 10 * time.Second
+)
+
+// AuditEvent is a single structured record describing an SFTP filesystem operation
+type AuditEvent struct {
+	Timestamp     time.Time
+	User          string
+	RemoteAddr    string
+	ClientVersion string
+	Method        string
+	VirtualPath   string
+	ResolvedPath  string
+	TargetPath    string
+	Bytes         int64
+	Duration      time.Duration
+	Err           string
+}
+
+// AuditSink receives batches of audit events, implementations can ship them to a JSON-lines
+// file, an HTTP webhook, the event manager or any other destination
+type AuditSink interface {
+	WriteEvents(events []AuditEvent) error
+}
+
+// auditManager coalesces audit events in memory and flushes them to the configured sink every
+// flushInterval or once bufferSize events have accumulated, whichever comes first. A naive
+// per-operation log would be unusable on busy servers
+type auditManager struct {
+	sink          AuditSink
+	bufferSize    int
+	flushInterval time.Duration
+
+	mu     sync.Mutex
+	events []AuditEvent
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+var auditLog = newAuditManager(nil, defaultAuditBufferSize, defaultAuditFlushInterval)
+
+func newAuditManager(sink AuditSink, bufferSize int, flushInterval time.Duration) *auditManager {
+	m := &auditManager{
+		sink:          sink,
+		bufferSize:    bufferSize,
+		flushInterval: flushInterval,
+		done:          make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
+
+// SetAuditSink configures where batched audit events are shipped to, pass nil to disable
+// audit event collection
+func SetAuditSink(sink AuditSink) {
+	auditLog.mu.Lock()
+	defer auditLog.mu.Unlock()
+	auditLog.sink = sink
+}
+
+// AuditBufferedEvents returns the number of audit events currently buffered, waiting for the
+// next flush, this is exposed through the telemetry/metrics endpoint
+func AuditBufferedEvents() int {
+	auditLog.mu.Lock()
+	defer auditLog.mu.Unlock()
+	return len(auditLog.events)
+}
+
+func (m *auditManager) run() {
+	ticker := time.NewTicker(m.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.flush()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *auditManager) record(ev AuditEvent) {
+	m.mu.Lock()
+	if m.sink == nil {
+		// nothing is going to drain the buffer, don't grow it without bound
+		m.mu.Unlock()
+		return
+	}
+	m.events = append(m.events, ev)
+	shouldFlush := len(m.events) >= m.bufferSize
+	m.mu.Unlock()
+
+	if shouldFlush {
+		m.flush()
+	}
+}
+
+func (m *auditManager) flush() {
+	m.mu.Lock()
+	if m.sink == nil {
+		// no sink configured (or it was cleared since these events were buffered), drop them
+		// instead of leaving them to accumulate forever
+		m.events = nil
+		m.mu.Unlock()
+		return
+	}
+	if len(m.events) == 0 {
+		m.mu.Unlock()
+		return
+	}
+	batch := m.events
+	m.events = nil
+	sink := m.sink
+	m.mu.Unlock()
+
+	sink.WriteEvents(batch) //nolint:errcheck
+}
+
+// recordAuditEvent fills in the fields common to every audit event and hands it to the batching
+// manager
+func (c *Connection) recordAuditEvent(method, virtualPath, resolvedPath, targetPath string, start time.Time, bytes int64, err error) {
+	ev := AuditEvent{
+		Timestamp:     start,
+		User:          c.User.Username,
+		RemoteAddr:    c.GetRemoteAddress(),
+		ClientVersion: c.ClientVersion,
+		Method:        method,
+		VirtualPath:   virtualPath,
+		ResolvedPath:  resolvedPath,
+		TargetPath:    targetPath,
+		Bytes:         bytes,
+		Duration:      time.Since(start),
+	}
+	if err != nil {
+		ev.Err = err.Error()
+	}
+	auditLog.record(ev)
+}
+
+// auditedReaderAt wraps the io.ReaderAt/io.Closer returned for a download so the transferred
+// byte count and duration can be filled in at transfer close. release, if set, is the pacer slot
+// acquired for the Open call: it is held for the handle's whole lifetime, not just the call to
+// Open, so MaxInFlight actually bounds concurrent transfers rather than just concurrent opens
+type auditedReaderAt struct {
+	io.ReaderAt
+	conn         *Connection
+	start        time.Time
+	virtualPath  string
+	resolvedPath string
+	bytes        int64
+	release      func()
+}
+
+func (a *auditedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := a.ReaderAt.ReadAt(p, off)
+	atomic.AddInt64(&a.bytes, int64(n))
+	return n, err
+}
+
+func (a *auditedReaderAt) Close() error {
+	var err error
+	if closer, ok := a.ReaderAt.(io.Closer); ok {
+		err = closer.Close()
+	}
+	if a.release != nil {
+		a.release()
+	}
+	a.conn.recordAuditEvent("Fileread", a.virtualPath, a.resolvedPath, "", a.start, atomic.LoadInt64(&a.bytes), err)
+	return err
+}
+
+// auditedWriterAt wraps the io.WriterAt/io.Closer returned for an upload so the transferred
+// byte count and duration can be filled in at transfer close. release, if set, is the pacer slot
+// acquired for the Create call: it is held for the handle's whole lifetime, not just the call to
+// Create, so MaxInFlight actually bounds concurrent transfers rather than just concurrent opens
+type auditedWriterAt struct {
+	io.WriterAt
+	conn         *Connection
+	start        time.Time
+	virtualPath  string
+	resolvedPath string
+	bytes        int64
+	release      func()
+}
+
+func (a *auditedWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	n, err := a.WriterAt.WriteAt(p, off)
+	atomic.AddInt64(&a.bytes, int64(n))
+	return n, err
+}
+
+func (a *auditedWriterAt) Close() error {
+	var err error
+	if closer, ok := a.WriterAt.(io.Closer); ok {
+		err = closer.Close()
+	}
+	if a.release != nil {
+		a.release()
+	}
+	a.conn.unregisterSyncer(a.resolvedPath)
+	a.conn.recordAuditEvent("Filewrite", a.virtualPath, a.resolvedPath, "", a.start, atomic.LoadInt64(&a.bytes), err)
+	return err
+}
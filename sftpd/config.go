@@ -0,0 +1,14 @@
+package sftpd
+
+// Configuration holds the sftpd service-wide settings that are not per-connection
+type Configuration struct {
+	// ReadOnly, if set, denies every write operation and every SSH command (SCP, git-receive-pack,
+	// rsync upload, ...) for all users, regardless of their own permissions. Intended for exposing
+	// a browse-only SFTP endpoint, e.g. release-artifact distribution, without having to strip
+	// every write permission bit from each user individually
+	ReadOnly bool
+}
+
+// Config is the active sftpd service configuration, populated at startup from the configuration
+// file
+var Config Configuration
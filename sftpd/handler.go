@@ -5,6 +5,7 @@ import (
 	"net"
 	"os"
 	"path"
+	"sync"
 	"time"
 
 	"github.com/pkg/sftp"
@@ -26,6 +27,11 @@ type Connection struct {
 	netConn    net.Conn
 	channel    ssh.Channel
 	command    string
+
+	syncersMu sync.Mutex
+	// syncers tracks the still-open write handles, keyed by resolved path, so that
+	// "fsync@openssh.com" requests can reach the underlying file
+	syncers map[string]syncer
 }
 
 // GetClientVersion returns the connected client's version
@@ -49,11 +55,25 @@ func (c *Connection) GetCommand() string {
 }
 
 // Fileread creates a reader for a file on the system and returns the reader back.
-func (c *Connection) Fileread(request *sftp.Request) (io.ReaderAt, error) {
+func (c *Connection) Fileread(request *sftp.Request) (reader io.ReaderAt, err error) {
 	c.UpdateLastActivity()
 
-	if !c.User.HasPerm(dataprovider.PermDownload, path.Dir(request.Filepath)) {
-		return nil, sftp.ErrSSHFxPermissionDenied
+	start := time.Now()
+	var resolvedPath string
+	defer func() {
+		// a successful open is audited with its own byte count/duration when the returned
+		// auditedReaderAt is closed, only record here the paths that never got that far
+		if err != nil {
+			c.recordAuditEvent("Fileread", request.Filepath, resolvedPath, "", start, 0, err)
+		}
+	}()
+
+	if !c.User.HasPerm(dataprovider.PermReadContent, path.Dir(request.Filepath)) {
+		// PermReadContent is new, fall back to PermDownload so users configured before the split
+		// keep working until they are migrated to the finer grained permission
+		if !c.User.HasPerm(dataprovider.PermDownload, path.Dir(request.Filepath)) {
+			return nil, sftp.ErrSSHFxPermissionDenied
+		}
 	}
 
 	if !c.User.IsFileAllowed(request.Filepath) {
@@ -65,24 +85,45 @@ func (c *Connection) Fileread(request *sftp.Request) (io.ReaderAt, error) {
 	if err != nil {
 		return nil, c.GetFsError(err)
 	}
+	resolvedPath = p
 
+	pc := getPacer(c)
+	release := pc.acquire()
 	file, r, cancelFn, err := c.Fs.Open(p, 0)
 	if err != nil {
+		release()
+		pc.reportResult(err)
 		c.Log(logger.LevelWarn, "could not open file %#v for reading: %+v", p, err)
 		return nil, c.GetFsError(err)
 	}
+	pc.reportResult(nil)
 
 	baseTransfer := common.NewBaseTransfer(file, c.BaseConnection, cancelFn, p, request.Filepath, common.TransferDownload,
 		0, 0, false)
 	t := newTransfer(baseTransfer, nil, r, 0)
 
-	return t, nil
+	return &auditedReaderAt{ReaderAt: t, conn: c, start: time.Now(), virtualPath: request.Filepath, resolvedPath: p, release: release}, nil
 }
 
 // Filewrite handles the write actions for a file on the system.
-func (c *Connection) Filewrite(request *sftp.Request) (io.WriterAt, error) {
+func (c *Connection) Filewrite(request *sftp.Request) (writer io.WriterAt, err error) {
 	c.UpdateLastActivity()
 
+	start := time.Now()
+	var resolvedPath string
+	defer func() {
+		// a successful open is audited with its own byte count/duration when the returned
+		// auditedWriterAt is closed, only record here the paths that never got that far
+		if err != nil {
+			c.recordAuditEvent("Filewrite", request.Filepath, resolvedPath, "", start, 0, err)
+		}
+	}()
+
+	if c.isReadOnly() {
+		c.Log(logger.LevelInfo, "denying write for file %#v, read-only mode is enabled", request.Filepath)
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+
 	if !c.User.IsFileAllowed(request.Filepath) {
 		c.Log(logger.LevelWarn, "writing file %#v is not allowed", request.Filepath)
 		return nil, sftp.ErrSSHFxPermissionDenied
@@ -92,6 +133,7 @@ func (c *Connection) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 	if err != nil {
 		return nil, c.GetFsError(err)
 	}
+	resolvedPath = p
 
 	filePath := p
 	if common.Config.IsAtomicUploadEnabled() && c.Fs.IsAtomicUploadSupported() {
@@ -126,13 +168,29 @@ func (c *Connection) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 
 // Filecmd hander for basic SFTP system calls related to files, but not anything to do with reading
 // or writing to those files.
-func (c *Connection) Filecmd(request *sftp.Request) error {
+func (c *Connection) Filecmd(request *sftp.Request) (err error) {
 	c.UpdateLastActivity()
 
+	start := time.Now()
+	var resolvedPath string
+	defer func() {
+		auditErr := err
+		if auditErr == sftp.ErrSSHFxOk {
+			auditErr = nil
+		}
+		c.recordAuditEvent(request.Method, request.Filepath, resolvedPath, request.Target, start, 0, auditErr)
+	}()
+
+	if c.isReadOnly() {
+		c.Log(logger.LevelInfo, "denying cmd %#v for file %#v, read-only mode is enabled", request.Method, request.Filepath)
+		return sftp.ErrSSHFxPermissionDenied
+	}
+
 	p, err := c.Fs.ResolvePath(request.Filepath)
 	if err != nil {
 		return c.GetFsError(err)
 	}
+	resolvedPath = p
 	target, err := c.getSFTPCmdTargetPath(request.Target)
 	if err != nil {
 		return c.GetFsError(err)
@@ -160,6 +218,14 @@ func (c *Connection) Filecmd(request *sftp.Request) error {
 		}
 	case "Remove":
 		return c.handleSFTPRemove(p, request)
+	// "posix-rename@openssh.com" and "hardlink@openssh.com" are NOT handled here: pkg/sftp
+	// translates both into a Request with this same Method ("Rename"/"Symlink" respectively, see
+	// HandlePosixRenameExtendedRequest/HandleHardlinkExtendedRequest in handler_extensions.go), so
+	// by the time a request reaches this switch the extension semantics are already gone
+	case "Fsync":
+		if err = c.handleSFTPFsync(p); err != nil {
+			return err
+		}
 	default:
 		return sftp.ErrSSHFxOpUnsupported
 	}
@@ -169,12 +235,20 @@ func (c *Connection) Filecmd(request *sftp.Request) error {
 
 // Filelist is the handler for SFTP filesystem list calls. This will handle calls to list the contents of
 // a directory as well as perform file/folder stat calls.
-func (c *Connection) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
+func (c *Connection) Filelist(request *sftp.Request) (lister sftp.ListerAt, err error) {
 	c.UpdateLastActivity()
+
+	start := time.Now()
+	var resolvedPath string
+	defer func() {
+		c.recordAuditEvent(request.Method, request.Filepath, resolvedPath, "", start, 0, err)
+	}()
+
 	p, err := c.Fs.ResolvePath(request.Filepath)
 	if err != nil {
 		return nil, c.GetFsError(err)
 	}
+	resolvedPath = p
 
 	switch request.Method {
 	case "List":
@@ -200,6 +274,25 @@ func (c *Connection) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
 	}
 }
 
+// isReadOnly returns true if write operations must be denied for this connection, either
+// because the server is configured in read-only mode or because the user is
+func (c *Connection) isReadOnly() bool {
+	return Config.ReadOnly || c.User.ReadOnly
+}
+
+// CheckSSHCommandAllowed must be called by the SSH-command dispatcher (scp, git-receive-pack,
+// rsync upload, ...) before running cmd: in server-wide read-only mode it rejects every SSH
+// command, read-only ones included, the same way Filewrite/Filecmd reject writes; per-user
+// ReadOnly does not apply here since read-only SSH commands (e.g. "scp -f") are still allowed for
+// a read-only user
+func (c *Connection) CheckSSHCommandAllowed(cmd string) error {
+	if Config.ReadOnly {
+		c.Log(logger.LevelInfo, "denying SSH command %#v, read-only mode is enabled", cmd)
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	return nil
+}
+
 func (c *Connection) getSFTPCmdTargetPath(requestTarget string) (string, error) {
 	var target string
 	// If a target is provided in this request validate that it is going to the correct
@@ -258,11 +351,16 @@ func (c *Connection) handleSFTPUploadToNewFile(resolvedPath, filePath, requestPa
 		return nil, sftp.ErrSSHFxFailure
 	}
 
+	pc := getPacer(c)
+	release := pc.acquire()
 	file, w, cancelFn, err := c.Fs.Create(filePath, 0)
 	if err != nil {
+		release()
+		pc.reportResult(err)
 		c.Log(logger.LevelWarn, "error creating file %#v: %+v", resolvedPath, err)
 		return nil, c.GetFsError(err)
 	}
+	pc.reportResult(nil)
 
 	vfs.SetPathPermissions(c.Fs, filePath, c.User.GetUID(), c.User.GetGID())
 
@@ -273,7 +371,9 @@ func (c *Connection) handleSFTPUploadToNewFile(resolvedPath, filePath, requestPa
 		common.TransferUpload, 0, 0, true)
 	t := newTransfer(baseTransfer, w, nil, maxWriteSize)
 
-	return t, nil
+	c.registerSyncer(resolvedPath, file)
+
+	return &auditedWriterAt{WriterAt: t, conn: c, start: time.Now(), virtualPath: requestPath, resolvedPath: resolvedPath, release: release}, nil
 }
 
 func (c *Connection) handleSFTPUploadToExistingFile(pflags sftp.FileOpenFlags, resolvedPath, filePath string,
@@ -306,11 +406,16 @@ func (c *Connection) handleSFTPUploadToExistingFile(pflags sftp.FileOpenFlags, r
 		}
 	}
 
+	pc := getPacer(c)
+	release := pc.acquire()
 	file, w, cancelFn, err := c.Fs.Create(filePath, osFlags)
 	if err != nil {
+		release()
+		pc.reportResult(err)
 		c.Log(logger.LevelWarn, "error opening existing file, flags: %v, source: %#v, err: %+v", pflags, filePath, err)
 		return nil, c.GetFsError(err)
 	}
+	pc.reportResult(nil)
 
 	initialSize := int64(0)
 	if isResume {
@@ -341,7 +446,9 @@ func (c *Connection) handleSFTPUploadToExistingFile(pflags sftp.FileOpenFlags, r
 		common.TransferUpload, minWriteOffset, initialSize, false)
 	t := newTransfer(baseTransfer, w, nil, maxWriteSize)
 
-	return t, nil
+	c.registerSyncer(resolvedPath, file)
+
+	return &auditedWriterAt{WriterAt: t, conn: c, start: time.Now(), virtualPath: requestPath, resolvedPath: resolvedPath, release: release}, nil
 }
 
 // Disconnect disconnects the client closing the network connection
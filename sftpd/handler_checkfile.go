@@ -0,0 +1,382 @@
+package sftpd
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+
+	"github.com/drakkan/sftpgo/common"
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+)
+
+// KNOWN LIMITATION: every Handle*ExtendedRequest in this file (and in handler_extensions.go)
+// assumes a "raw packet-dispatch loop" that inspects an incoming SSH_FXP_EXTENDED packet's
+// extension name before it reaches pkg/sftp's own dispatch, and writes the reply straight to
+// c.channel. This repo drives the SFTP channel through sftp.NewRequestServer, whose Handlers
+// model has no hook for that kind of pre-dispatch interception and already owns writes to the
+// channel on its own goroutine, so a second writer racing it would interleave frames on the wire.
+// No such dispatch loop exists anywhere in this package yet, which means check-file is currently
+// unreachable from a running server: wiring it up needs either a custom io.ReadWriter shim placed
+// in front of RequestServer that peeks the extension name and only forwards non-extension packets
+// to it, or an upstream pkg/sftp hook that does not exist today. Do not assume this is wired in
+// without checking how the server is actually constructed.
+const (
+	// checkFileMinBlockSize is the smallest block size we will honor for a check-file request
+	checkFileMinBlockSize = 256
+	// checkFileMaxBlockSize is the largest block size we will honor for a check-file request
+	checkFileMaxBlockSize = 32 * 1024 * 1024
+
+	sshFxpExtended      byte = 200
+	sshFxpExtendedReply byte = 201
+	sshFxpStatus        byte = 101
+)
+
+// checkFileHashFuncs maps the hash-algorithm names advertised for the check-file extension
+// to the corresponding constructor, in the preference order we report to the client
+var checkFileHashFuncs = []struct {
+	name    string
+	newHash func() hash.Hash
+}{
+	{"sha256-hash", sha256.New},
+	{"sha512-hash", sha512.New},
+	{"sha1-hash", sha1.New},
+	{"md5-hash", md5.New},
+}
+
+// CheckFileExtensionPairs returns the "check-file"/hash-algorithm extension pairs this server
+// advertises in its SSH_FXP_VERSION packet, pass these to the request-server's Extensions option
+func CheckFileExtensionPairs() []sftp.ExtensionPair {
+	names := make([]string, len(checkFileHashFuncs))
+	for i, h := range checkFileHashFuncs {
+		names[i] = h.name
+	}
+	return []sftp.ExtensionPair{
+		{Name: "check-file", Data: strings.Join(names, ",")},
+	}
+}
+
+// HandleCheckFileExtendedRequest answers a raw "check-file-name" SSH_FXP_EXTENDED request.
+// pkg/sftp's Handlers interface has no way to carry a custom extended-reply payload back to the
+// client (Filecmd only ever returns an error, which the library turns into a plain STATUS
+// packet), so check-file cannot be wired up like the other extensions in handler_extensions.go.
+// Instead this must be called directly from the raw packet-dispatch loop for "check-file-name"
+// packets, before they would otherwise reach the generic Handlers-based dispatch; reqID is the
+// SSH_FXP_EXTENDED request-id and payload is everything in the packet after the extension name.
+// "check-file-handle" (verifying against an already-open handle rather than a path) is a known
+// limitation, not implemented here, see HandleCheckFileHandleExtendedRequest.
+func (c *Connection) HandleCheckFileExtendedRequest(reqID uint32, payload []byte) error {
+	c.UpdateLastActivity()
+	start := time.Now()
+
+	virtualPath, algoList, startOffset, length, blockSize, err := decodeCheckFileNamePayload(payload)
+	if err != nil {
+		return c.writeExtendedStatus(reqID, sftp.ErrSSHFxBadMessage)
+	}
+
+	if !c.User.HasPerm(dataprovider.PermReadContent, path.Dir(virtualPath)) {
+		if !c.User.HasPerm(dataprovider.PermDownload, path.Dir(virtualPath)) {
+			return c.writeExtendedStatus(reqID, sftp.ErrSSHFxPermissionDenied)
+		}
+	}
+	if !c.User.IsFileAllowed(virtualPath) {
+		c.Log(logger.LevelWarn, "check-file for %#v is not allowed", virtualPath)
+		return c.writeExtendedStatus(reqID, sftp.ErrSSHFxPermissionDenied)
+	}
+
+	algo, newHash := pickCheckFileHash(algoList)
+	if newHash == nil {
+		return c.writeExtendedStatus(reqID, sftp.ErrSSHFxOpUnsupported)
+	}
+
+	// a block-size of 0 is not "use our minimum", draft-ietf-secsh-filexfer-13 defines it as "hash
+	// the whole [offset, length) range as a single block", leave it alone and let
+	// computeCheckFileHashes expand it once the range is known
+	if blockSize != 0 {
+		if blockSize < checkFileMinBlockSize {
+			blockSize = checkFileMinBlockSize
+		}
+		if blockSize > checkFileMaxBlockSize {
+			blockSize = checkFileMaxBlockSize
+		}
+	}
+
+	p, err := c.Fs.ResolvePath(virtualPath)
+	if err != nil {
+		return c.writeExtendedStatus(reqID, c.GetFsError(err))
+	}
+
+	pc := getPacer(c)
+	release := pc.acquire()
+	defer release()
+	file, r, cancelFn, err := c.Fs.Open(p, 0)
+	pc.reportResult(err)
+	if err != nil {
+		c.Log(logger.LevelWarn, "could not open file %#v for check-file: %+v", p, err)
+		return c.writeExtendedStatus(reqID, c.GetFsError(err))
+	}
+
+	baseTransfer := common.NewBaseTransfer(file, c.BaseConnection, cancelFn, p, virtualPath, common.TransferDownload,
+		0, 0, false)
+	t := newTransfer(baseTransfer, nil, r, 0)
+	defer t.Close() //nolint:errcheck
+
+	hashes, err := computeCheckFileHashes(t, newHash, startOffset, length, blockSize)
+	if err != nil {
+		c.Log(logger.LevelWarn, "error computing %v check-file hashes for %#v: %+v", algo, p, err)
+		return c.writeExtendedStatus(reqID, c.GetFsError(err))
+	}
+
+	c.recordAuditEvent("check-file-name", virtualPath, p, "", start, int64(len(hashes)), nil)
+
+	return writeSFTPExtendedPacket(c.channel, sshFxpExtendedReply, reqID, func(buf *bytes.Buffer) {
+		writeSSHString(buf, algo)
+		writeSSHString(buf, string(hashes))
+	})
+}
+
+// HandleCheckFileHandleExtendedRequest would answer a raw "check-file-handle" SSH_FXP_EXTENDED
+// request, the variant of check-file that verifies against an already-open handle rather than a
+// path. It is not implemented: resolving the handle string back to the open file requires
+// pkg/sftp's internal handle table, which the Handlers interface we drive the server through does
+// not expose, so there is no way to reach it from outside the library. Always reply unsupported
+// rather than silently dropping the request.
+func (c *Connection) HandleCheckFileHandleExtendedRequest(reqID uint32, payload []byte) error {
+	c.UpdateLastActivity()
+	return c.writeExtendedStatus(reqID, sftp.ErrSSHFxOpUnsupported)
+}
+
+// pickCheckFileHash returns, among the hash algorithms named in algoList (a comma separated list,
+// as sent by the client) that this server also supports, the one that comes first in our own
+// advertised order; the order of the client's list is not taken into account
+func pickCheckFileHash(algoList string) (string, func() hash.Hash) {
+	requested := make(map[string]bool)
+	for _, a := range strings.Split(algoList, ",") {
+		requested[strings.TrimSpace(a)] = true
+	}
+	for _, h := range checkFileHashFuncs {
+		if requested[h.name] {
+			return h.name, h.newHash
+		}
+	}
+	return "", nil
+}
+
+// computeCheckFileHashes reads r in blockSize chunks starting at startOffset, for length bytes
+// (or until EOF if length is 0), and returns the concatenation of the per-block digests produced
+// by newHash, as required by the check-file extension response. A blockSize of 0 means "one hash
+// over the whole [startOffset, startOffset+length) range" per draft-ietf-secsh-filexfer-13, rather
+// than a block size to honor, so the whole range is read and hashed as a single digest
+func computeCheckFileHashes(r io.ReaderAt, newHash func() hash.Hash, startOffset, length int64, blockSize uint32) ([]byte, error) {
+	if blockSize == 0 {
+		return computeCheckFileWholeRangeHash(r, newHash, startOffset, length)
+	}
+
+	var result []byte
+	buf := make([]byte, blockSize)
+	offset := startOffset
+	remaining := length
+
+	for length == 0 || remaining > 0 {
+		readSize := int64(blockSize)
+		if length != 0 && remaining < readSize {
+			readSize = remaining
+		}
+
+		n, err := r.ReadAt(buf[:readSize], offset)
+		if n > 0 {
+			h := newHash()
+			h.Write(buf[:n])
+			result = append(result, h.Sum(nil)...)
+			offset += int64(n)
+			if length != 0 {
+				remaining -= int64(n)
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+// computeCheckFileWholeRangeHash hashes the whole [startOffset, startOffset+length) range (or up
+// to EOF if length is 0) as a single digest, reading it in internal checkFileMaxBlockSize chunks
+// so arbitrarily large ranges don't have to be buffered in memory at once
+func computeCheckFileWholeRangeHash(r io.ReaderAt, newHash func() hash.Hash, startOffset, length int64) ([]byte, error) {
+	h := newHash()
+	buf := make([]byte, checkFileMaxBlockSize)
+	offset := startOffset
+	remaining := length
+
+	for length == 0 || remaining > 0 {
+		readSize := int64(len(buf))
+		if length != 0 && remaining < readSize {
+			readSize = remaining
+		}
+
+		n, err := r.ReadAt(buf[:readSize], offset)
+		if n > 0 {
+			h.Write(buf[:n])
+			offset += int64(n)
+			if length != 0 {
+				remaining -= int64(n)
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	return h.Sum(nil), nil
+}
+
+// decodeCheckFileNamePayload parses the part of a "check-file-name" SSH_FXP_EXTENDED packet that
+// follows the extension-name string: filename, hash-algorithm-list, start-offset, length and
+// block-size, as laid out in draft-ietf-secsh-filexfer-13
+func decodeCheckFileNamePayload(b []byte) (filename, algoList string, startOffset, length int64, blockSize uint32, err error) {
+	filename, b, err = readSSHString(b)
+	if err != nil {
+		return
+	}
+	algoList, b, err = readSSHString(b)
+	if err != nil {
+		return
+	}
+	var off, l uint64
+	off, b, err = readSSHUint64(b)
+	if err != nil {
+		return
+	}
+	l, b, err = readSSHUint64(b)
+	if err != nil {
+		return
+	}
+	var bs uint32
+	bs, _, err = readSSHUint32(b)
+	if err != nil {
+		return
+	}
+	return filename, algoList, int64(off), int64(l), bs, nil
+}
+
+var errShortSSHBuffer = errors.New("sftpd: truncated extended-request payload")
+
+func readSSHUint32(b []byte) (uint32, []byte, error) {
+	if len(b) < 4 {
+		return 0, nil, errShortSSHBuffer
+	}
+	return binary.BigEndian.Uint32(b), b[4:], nil
+}
+
+func readSSHUint64(b []byte) (uint64, []byte, error) {
+	if len(b) < 8 {
+		return 0, nil, errShortSSHBuffer
+	}
+	return binary.BigEndian.Uint64(b), b[8:], nil
+}
+
+func readSSHString(b []byte) (string, []byte, error) {
+	n, rest, err := readSSHUint32(b)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint32(len(rest)) < n {
+		return "", nil, errShortSSHBuffer
+	}
+	return string(rest[:n]), rest[n:], nil
+}
+
+func writeSSHString(buf *bytes.Buffer, s string) {
+	var lenBytes [4]byte
+	binary.BigEndian.PutUint32(lenBytes[:], uint32(len(s)))
+	buf.Write(lenBytes[:])
+	buf.WriteString(s)
+}
+
+// writeSFTPExtendedPacket frames an SFTP response packet (4 byte length prefix, 1 byte type,
+// 4 byte request-id, then the body written by fillBody) and writes it directly to w, bypassing
+// pkg/sftp's own reply path
+func writeSFTPExtendedPacket(w io.Writer, packetType byte, reqID uint32, fillBody func(*bytes.Buffer)) error {
+	var body bytes.Buffer
+	body.WriteByte(packetType)
+	var reqIDBytes [4]byte
+	binary.BigEndian.PutUint32(reqIDBytes[:], reqID)
+	body.Write(reqIDBytes[:])
+	fillBody(&body)
+
+	var lenBytes [4]byte
+	binary.BigEndian.PutUint32(lenBytes[:], uint32(body.Len()))
+	if _, err := w.Write(lenBytes[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(body.Bytes())
+	return err
+}
+
+// writeExtendedStatus replies to a raw SSH_FXP_EXTENDED request with an SSH_FXP_STATUS packet
+// carrying err's numeric SSH_FX_* code (SSH_FX_OK when err is nil), shared by every
+// Handle*ExtendedRequest method that bypasses pkg/sftp's own reply path (check-file, posix-rename,
+// hardlink)
+func (c *Connection) writeExtendedStatus(reqID uint32, err error) error {
+	status := err
+	if status == nil {
+		status = sftp.ErrSSHFxOk
+	}
+	writeErr := writeSFTPExtendedPacket(c.channel, sshFxpStatus, reqID, func(buf *bytes.Buffer) {
+		var codeBytes [4]byte
+		binary.BigEndian.PutUint32(codeBytes[:], sftpStatusCode(status))
+		buf.Write(codeBytes[:])
+		writeSSHString(buf, status.Error())
+		writeSSHString(buf, "en")
+	})
+	if writeErr != nil {
+		return writeErr
+	}
+	return err
+}
+
+// sftpStatusCode maps the sftp.ErrSSHFx* sentinel errors to the numeric SSH_FX_* status code
+// they represent on the wire
+func sftpStatusCode(err error) uint32 {
+	switch err {
+	case sftp.ErrSSHFxOk:
+		return 0
+	case sftp.ErrSSHFxEOF:
+		return 1
+	case sftp.ErrSSHFxNoSuchFile:
+		return 2
+	case sftp.ErrSSHFxPermissionDenied:
+		return 3
+	case sftp.ErrSSHFxBadMessage:
+		return 5
+	case sftp.ErrSSHFxOpUnsupported:
+		return 8
+	default:
+		return 4 // SSH_FX_FAILURE
+	}
+}
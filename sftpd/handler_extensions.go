@@ -0,0 +1,248 @@
+package sftpd
+
+import (
+	"path"
+	"time"
+
+	"github.com/pkg/sftp"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+// RawExtensionPairs returns the "posix-rename@openssh.com"/"hardlink@openssh.com" extension pairs
+// this server advertises in its SSH_FXP_VERSION packet. Both must be routed to the matching
+// Handle*ExtendedRequest method below from the raw packet-dispatch loop rather than through
+// Filecmd, see those methods' doc comments for why.
+//
+// KNOWN LIMITATION: that raw packet-dispatch loop does not exist anywhere in this package. This
+// repo drives the SFTP channel through sftp.NewRequestServer, and its Handlers model has no hook
+// for intercepting SSH_FXP_EXTENDED before the library's own dispatch, nor any way to write a
+// reply to c.channel without racing the RequestServer's own writer goroutine. Until a shim that
+// peeks the extension name ahead of RequestServer (or an equivalent upstream hook) is added,
+// HandlePosixRenameExtendedRequest and HandleHardlinkExtendedRequest below are unreachable from a
+// running server, same as HandleCheckFileExtendedRequest in handler_checkfile.go
+func RawExtensionPairs() []sftp.ExtensionPair {
+	return []sftp.ExtensionPair{
+		{Name: "posix-rename@openssh.com", Data: "1"},
+		{Name: "hardlink@openssh.com", Data: "1"},
+	}
+}
+
+// syncer is implemented by the underlying filesystem file handles that support an explicit
+// flush, a plain *os.File on the local back-end does, an object-store upload typically does not
+type syncer interface {
+	Sync() error
+}
+
+// registerSyncer tracks filePath's open write handle so a later "fsync@openssh.com" request for
+// the same path can reach it, files that don't support Sync are not tracked
+func (c *Connection) registerSyncer(filePath string, file interface{}) {
+	s, ok := file.(syncer)
+	if !ok {
+		return
+	}
+	c.syncersMu.Lock()
+	defer c.syncersMu.Unlock()
+	if c.syncers == nil {
+		c.syncers = make(map[string]syncer)
+	}
+	c.syncers[filePath] = s
+}
+
+func (c *Connection) unregisterSyncer(filePath string) {
+	c.syncersMu.Lock()
+	defer c.syncersMu.Unlock()
+	delete(c.syncers, filePath)
+}
+
+func (c *Connection) getSyncer(filePath string) (syncer, bool) {
+	c.syncersMu.Lock()
+	defer c.syncersMu.Unlock()
+	s, ok := c.syncers[filePath]
+	return s, ok
+}
+
+// StatVFS implements pkg/sftp's optional StatVFSFileLister interface for the
+// "statvfs@openssh.com"/"fstatvfs@openssh.com" requests: the request-server type-asserts the
+// Handlers.FileList value (Connection, via Filelist) against that interface, so this method is
+// picked up automatically once Connection is wired in as FileList, no separate registration call
+// is needed here. Since quotas, not the underlying filesystem, are what actually bound a SFTPGo
+// user, the free/total block counts are derived from the user's quota rather than the real
+// filesystem statistics, this also lets it work for the S3/GCS/Azure back-ends where a native
+// statvfs call makes no sense
+func (c *Connection) StatVFS(request *sftp.Request) (*sftp.StatVFS, error) {
+	c.UpdateLastActivity()
+
+	if !c.User.HasPerm(dataprovider.PermListItems, path.Dir(request.Filepath)) {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+
+	const blockSize = 4096
+
+	totalSize := c.User.QuotaSize
+	usedSize := c.User.UsedQuotaSize
+	var freeBlocks uint64
+	if totalSize > 0 {
+		if usedSize >= totalSize {
+			freeBlocks = 0
+		} else {
+			freeBlocks = uint64(totalSize-usedSize) / blockSize
+		}
+	} else {
+		// unlimited quota, report a large but finite amount of free space
+		freeBlocks = (1 << 40) / blockSize
+	}
+
+	totalBlocks := freeBlocks
+	if totalSize > 0 {
+		totalBlocks = uint64(totalSize) / blockSize
+	}
+
+	return &sftp.StatVFS{
+		Bsize:   blockSize,
+		Frsize:  blockSize,
+		Blocks:  totalBlocks,
+		Bfree:   freeBlocks,
+		Bavail:  freeBlocks,
+		Files:   1000000,
+		Ffree:   1000000,
+		Namemax: 255,
+	}, nil
+}
+
+// HandlePosixRenameExtendedRequest answers a raw "posix-rename@openssh.com" SSH_FXP_EXTENDED
+// request. pkg/sftp translates this extension into a plain Request{Method: "Rename"}, identical
+// to the one a native SSH_FXP_RENAME produces, so by the time Filecmd would see it there is no
+// way left to tell the two apart and recover posix-rename's atomic-overwrite semantics (see the
+// comment in Filecmd's method switch). This must therefore be called directly from the raw
+// packet-dispatch loop for "posix-rename@openssh.com" packets, before they would otherwise reach
+// the generic Handlers-based dispatch; reqID is the SSH_FXP_EXTENDED request-id and payload is
+// everything in the packet after the extension name (oldpath, then newpath).
+func (c *Connection) HandlePosixRenameExtendedRequest(reqID uint32, payload []byte) error {
+	c.UpdateLastActivity()
+
+	if c.isReadOnly() {
+		c.Log(logger.LevelInfo, "denying posix-rename, read-only mode is enabled")
+		return c.writeExtendedStatus(reqID, sftp.ErrSSHFxPermissionDenied)
+	}
+
+	virtualSource, virtualTarget, err := decodeRenamePairPayload(payload)
+	if err != nil {
+		return c.writeExtendedStatus(reqID, sftp.ErrSSHFxBadMessage)
+	}
+
+	source, err := c.Fs.ResolvePath(virtualSource)
+	if err != nil {
+		return c.writeExtendedStatus(reqID, c.GetFsError(err))
+	}
+	target, err := c.Fs.ResolvePath(virtualTarget)
+	if err != nil {
+		return c.writeExtendedStatus(reqID, c.GetFsError(err))
+	}
+
+	start := time.Now()
+	err = c.handleSFTPPosixRename(source, target, virtualSource, virtualTarget)
+	c.recordAuditEvent("posix-rename@openssh.com", virtualSource, source, virtualTarget, start, 0, err)
+
+	return c.writeExtendedStatus(reqID, err)
+}
+
+// handleSFTPPosixRename implements the "posix-rename@openssh.com" extension: unlike the plain
+// SFTP RENAME request it overwrites an existing destination. An existing non-directory target is
+// removed first and source is then renamed onto it; these are two separate steps, so the
+// replacement is not atomic
+func (c *Connection) handleSFTPPosixRename(source, target, virtualSource, virtualTarget string) error {
+	if stat, err := c.Fs.Lstat(target); err == nil && !stat.IsDir() {
+		if err := c.RemoveFile(target, virtualTarget, stat); err != nil {
+			return err
+		}
+	}
+
+	return c.Rename(source, target, virtualSource, virtualTarget)
+}
+
+// HandleHardlinkExtendedRequest answers a raw "hardlink@openssh.com" SSH_FXP_EXTENDED request.
+// Like posix-rename, pkg/sftp translates this extension into a plain Request{Method: "Symlink"},
+// so it can't be distinguished from a real symlink request once it reaches Filecmd and must be
+// intercepted here instead; reqID is the SSH_FXP_EXTENDED request-id and payload is everything in
+// the packet after the extension name (oldpath, then newpath).
+func (c *Connection) HandleHardlinkExtendedRequest(reqID uint32, payload []byte) error {
+	c.UpdateLastActivity()
+
+	if c.isReadOnly() {
+		c.Log(logger.LevelInfo, "denying hardlink, read-only mode is enabled")
+		return c.writeExtendedStatus(reqID, sftp.ErrSSHFxPermissionDenied)
+	}
+
+	virtualSource, virtualTarget, err := decodeRenamePairPayload(payload)
+	if err != nil {
+		return c.writeExtendedStatus(reqID, sftp.ErrSSHFxBadMessage)
+	}
+
+	source, err := c.Fs.ResolvePath(virtualSource)
+	if err != nil {
+		return c.writeExtendedStatus(reqID, c.GetFsError(err))
+	}
+	target, err := c.Fs.ResolvePath(virtualTarget)
+	if err != nil {
+		return c.writeExtendedStatus(reqID, c.GetFsError(err))
+	}
+
+	start := time.Now()
+	err = c.handleSFTPHardlink(source, target)
+	c.recordAuditEvent("hardlink@openssh.com", virtualSource, source, virtualTarget, start, 0, err)
+
+	return c.writeExtendedStatus(reqID, err)
+}
+
+// handleSFTPHardlink implements the "hardlink@openssh.com" extension, it is only supported on
+// back-ends whose Fs implementation knows how to create a hard link, object-store back-ends
+// don't, so SSH_FX_OP_UNSUPPORTED is returned for them
+func (c *Connection) handleSFTPHardlink(source, target string) error {
+	linker, ok := c.Fs.(vfs.HardLinker)
+	if !ok {
+		return sftp.ErrSSHFxOpUnsupported
+	}
+
+	if err := linker.Link(source, target); err != nil {
+		c.Log(logger.LevelWarn, "error creating hardlink, source: %#v, target: %#v, err: %+v", source, target, err)
+		return c.GetFsError(err)
+	}
+
+	c.Log(logger.LevelDebug, "hardlink created, source: %#v, target: %#v", source, target)
+	return nil
+}
+
+// decodeRenamePairPayload parses the part of a "posix-rename@openssh.com"/"hardlink@openssh.com"
+// SSH_FXP_EXTENDED packet that follows the extension-name string: the source and target paths
+func decodeRenamePairPayload(b []byte) (source, target string, err error) {
+	source, b, err = readSSHString(b)
+	if err != nil {
+		return "", "", err
+	}
+	target, _, err = readSSHString(b)
+	if err != nil {
+		return "", "", err
+	}
+	return source, target, nil
+}
+
+// handleSFTPFsync implements the "fsync@openssh.com" extension: it forces a flush of the file
+// handle open for filePath before the client closes it, this is required by databases and
+// backup tools, such as restic/borg, that run over SFTP. It is a no-op, not an error, for
+// back-ends whose handles don't support an explicit flush
+func (c *Connection) handleSFTPFsync(filePath string) error {
+	s, ok := c.getSyncer(filePath)
+	if !ok {
+		return nil
+	}
+
+	if err := s.Sync(); err != nil {
+		c.Log(logger.LevelWarn, "error syncing file %#v: %+v", filePath, err)
+		return c.GetFsError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,200 @@
+package sftpd
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// pacerConfig holds the tunables for a single pacer instance, mirroring the token bucket with
+// exponential-decay backoff that rclone's sftp backend uses against rate-limited object stores
+type pacerConfig struct {
+	MinSleep    time.Duration
+	MaxSleep    time.Duration
+	DecayConst  float64
+	MaxInFlight int
+}
+
+var defaultPacerConfig = pacerConfig{
+	MinSleep:    10 * time.Millisecond,
+	MaxSleep:    2 * time.Second,
+	DecayConst:  2,
+	MaxInFlight: 32,
+}
+
+// pacer coordinates concurrent Fileread/Filewrite handle opens against a single FS back-end,
+// it keeps every caller under MaxInFlight and stretches the sleep between opens whenever a
+// retriable error (429/5xx) is reported, decaying it back down on success
+type pacer struct {
+	cfg pacerConfig
+
+	mu         sync.Mutex
+	sleep      time.Duration
+	inFlightCh chan struct{}
+
+	waitDuration int64 // nanoseconds spent waiting, exposed as a metric
+}
+
+func newPacer(cfg pacerConfig) *pacer {
+	if cfg.MaxInFlight <= 0 {
+		cfg.MaxInFlight = defaultPacerConfig.MaxInFlight
+	}
+	if cfg.MinSleep <= 0 {
+		cfg.MinSleep = defaultPacerConfig.MinSleep
+	}
+	if cfg.MaxSleep <= 0 {
+		cfg.MaxSleep = defaultPacerConfig.MaxSleep
+	}
+	if cfg.DecayConst <= 0 {
+		cfg.DecayConst = defaultPacerConfig.DecayConst
+	}
+	return &pacer{
+		cfg:        cfg,
+		sleep:      cfg.MinSleep,
+		inFlightCh: make(chan struct{}, cfg.MaxInFlight),
+	}
+}
+
+// acquire blocks until a slot is available and the current pacing sleep has elapsed, the
+// returned release func must be called once the caller is done with the FS handle it opened
+func (p *pacer) acquire() (release func()) {
+	start := time.Now()
+
+	p.mu.Lock()
+	sleep := p.sleep
+	p.mu.Unlock()
+	if sleep > 0 {
+		time.Sleep(sleep)
+	}
+
+	p.inFlightCh <- struct{}{}
+
+	p.mu.Lock()
+	p.waitDuration += int64(time.Since(start))
+	p.mu.Unlock()
+
+	var released sync.Once
+	return func() {
+		released.Do(func() {
+			<-p.inFlightCh
+		})
+	}
+}
+
+// reportResult classifies a transfer error as retriable and adjusts the pacing sleep
+// accordingly: retriable errors stretch the sleep (capped at MaxSleep), everything else decays
+// it back towards MinSleep
+func (p *pacer) reportResult(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err != nil && isRetriableFsError(err) {
+		p.sleep *= time.Duration(p.cfg.DecayConst)
+		if p.sleep > p.cfg.MaxSleep {
+			p.sleep = p.cfg.MaxSleep
+		}
+		return
+	}
+
+	p.sleep = time.Duration(float64(p.sleep) / p.cfg.DecayConst)
+	if p.sleep < p.cfg.MinSleep {
+		p.sleep = p.cfg.MinSleep
+	}
+}
+
+// waitNanos returns the total time spent waiting on this pacer so far, exposed through the
+// telemetry/metrics endpoint
+func (p *pacer) waitNanos() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.waitDuration
+}
+
+// isRetriableFsError reports whether err looks like a rate-limit or transient server error from
+// an object-store back-end (HTTP 429/5xx), these are the only errors the pacer backs off on
+func isRetriableFsError(err error) bool {
+	type statusCoder interface {
+		StatusCode() int
+	}
+	if sc, ok := err.(statusCoder); ok {
+		code := sc.StatusCode()
+		return code == 429 || code >= 500
+	}
+	return false
+}
+
+// pacers holds one pacer per FS type, keyed by the name the VFS package uses to identify a
+// back-end (e.g. "osFs", "S3Fs", "GCSFs", "AzureBlobFs"), so S3 and GCS back-ends are paced
+// independently
+var (
+	pacersMu sync.Mutex
+	pacers   = make(map[string]*pacer)
+)
+
+// getPacer returns the pacer for the given connection's FS type, creating it on first use. There
+// is a single pacer per FS type shared by every connection against that back-end, there is no
+// per-user override
+func getPacer(c *Connection) *pacer {
+	key := baseFsType(vfsFsType(c))
+
+	pacersMu.Lock()
+	defer pacersMu.Unlock()
+
+	if p, ok := pacers[key]; ok {
+		return p
+	}
+
+	p := newPacer(pacerConfigForFsType(key))
+	pacers[key] = p
+	return p
+}
+
+// vfsFsType returns the name the VFS package uses to identify the back-end behind c.Fs
+func vfsFsType(c *Connection) string {
+	if named, ok := c.Fs.(interface{ Name() string }); ok {
+		return named.Name()
+	}
+	return "unknown"
+}
+
+// baseFsType strips the bucket/container suffix object-store back-ends append to their Fs.Name()
+// (e.g. `S3Fs bucket "mybucket"` becomes "S3Fs"), so pacerConfigForFsType can match on the stable
+// type identifier instead of the fully-qualified name, which differs per configured bucket
+func baseFsType(fsType string) string {
+	if idx := strings.IndexByte(fsType, ' '); idx >= 0 {
+		return fsType[:idx]
+	}
+	return fsType
+}
+
+// pacerConfigForFsType returns the pacing defaults for a given FS back-end, object-store
+// back-ends get a more conservative default since they are the ones that rate-limit aggressively.
+// fsType is whatever the back-end's Fs.Name() returns, e.g. `S3Fs bucket "x"`, `GCSFs bucket "x"`,
+// `AzureBlobFs container "x"`, "osFs" -- object stores qualify the bare type name with their
+// bucket/container, so match on the base type rather than the full string
+func pacerConfigForFsType(fsType string) pacerConfig {
+	switch baseFsType(fsType) {
+	case "S3Fs", "GCSFs", "AzureBlobFs":
+		return pacerConfig{
+			MinSleep:    50 * time.Millisecond,
+			MaxSleep:    5 * time.Second,
+			DecayConst:  2,
+			MaxInFlight: 16,
+		}
+	default:
+		return defaultPacerConfig
+	}
+}
+
+// PacerWaitNanos returns the total time, in nanoseconds, every pacer has spent waiting so far,
+// exposed through the telemetry/metrics endpoint
+func PacerWaitNanos() map[string]int64 {
+	pacersMu.Lock()
+	defer pacersMu.Unlock()
+
+	result := make(map[string]int64, len(pacers))
+	for fsType, p := range pacers {
+		result[fsType] = p.waitNanos()
+	}
+	return result
+}
@@ -0,0 +1,9 @@
+package vfs
+
+// HardLinker is implemented by Fs back-ends that can create a hard link between two paths on the
+// same underlying filesystem, such as the local osFs. Object-store back-ends (S3/GCS/Azure) have
+// no equivalent operation and don't implement it; callers should type-assert c.Fs against this
+// interface and fall back to SSH_FX_OP_UNSUPPORTED when it fails
+type HardLinker interface {
+	Link(source, target string) error
+}